@@ -4,7 +4,7 @@ import (
 	"container/heap"
 	"fmt"
 	"math"
-	"sort"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +24,18 @@ type pipeSort struct {
 
 	// whether to apply descending order
 	isDesc bool
+
+	// limit, when non-zero, bounds this pipeSort to keeping only the top limit
+	// rows in a bounded heap per shard instead of buffering and sorting every
+	// row - see pipeSortProcessorShard.writeBlock().
+	//
+	// limit is populated by optimizePipeSortLimit() when this pipeSort is
+	// immediately followed by a '| limit N' pipe.
+	//
+	// TODO: the pipe chain construction code doesn't call optimizePipeSortLimit()
+	// yet, so in practice this is currently only reachable by constructing a
+	// pipeSort directly with limit already set.
+	limit uint64
 }
 
 func (ps *pipeSort) String() string {
@@ -89,6 +101,10 @@ type pipeSortProcessor struct {
 
 	maxStateSize    int64
 	stateSizeBudget atomic.Int64
+
+	// spillErr is set if spilling a shard's state to disk fails in writeBlock().
+	// flush() checks it before attempting to merge anything.
+	spillErr atomic.Value
 }
 
 type pipeSortProcessorShard struct {
@@ -116,6 +132,28 @@ type pipeSortProcessorShardNopad struct {
 	// stateSizeBudget is the remaining budget for the whole state size for the shard.
 	// The per-shard budget is provided in chunks from the parent pipeSortProcessor.
 	stateSizeBudget int
+
+	// blockRefCounts[i] is the number of entries in rowRefs pointing to blocks[i].
+	// It is only maintained when ps.limit > 0 - see writeBlockTopN() and pruneEmptyBlocks().
+	blockRefCounts []int
+
+	// runPaths holds the paths of the temporary run files this shard has spilled
+	// to disk so far, in the order they were written. They are merged alongside
+	// the shard's remaining in-memory rows in pipeSortProcessor.flush().
+	runPaths []string
+
+	// run is non-nil for shards created by newSortRunSource() to read a spilled
+	// run file back during the merge phase. It is nil for regular shards.
+	run *sortRunSource
+
+	// sortStopCh and sortCmpCount are used by sortShardCancellable() to interrupt
+	// a long-running sort.Sort(shard) once sortStopCh is closed.
+	sortStopCh   <-chan struct{}
+	sortCmpCount int
+
+	// blockIdxRemap is reused scratch space by pruneEmptyBlocks() across calls,
+	// so compacting out freed blocks doesn't allocate on every call.
+	blockIdxRemap []int
 }
 
 // sortBlock represents a block of logs for sorting.
@@ -131,6 +169,10 @@ type sortBlock struct {
 }
 
 // sortBlockByColumn represents data for a single column from 'sort by(...)' clause.
+//
+// sortBlockLessRefs() picks the value to compare on according to the following
+// precedence: time column > RFC3339 timestamp parsed from the string value >
+// duration parsed from the string value > i64Values > f64Values > raw string value.
 type sortBlockByColumn struct {
 	// c contains column data
 	c *blockResultColumn
@@ -140,6 +182,25 @@ type sortBlockByColumn struct {
 
 	// f64Values contains float64 numbers parsed from values
 	f64Values []float64
+
+	// tsValues contains unix nanosecond timestamps parsed from values, e.g. RFC3339 strings
+	// such as "2024-01-02T03:04:05Z". It is left empty for isTime columns, for natural
+	// columns and for the single column built when sorting by all the fields; such columns
+	// have no parsed timestamps - see getTimestampValueAtRow().
+	tsValues []int64
+
+	// tsOK reports, per row, whether the corresponding tsValues entry was actually
+	// parsed from a timestamp - a zero tsValues entry is ambiguous with the Unix
+	// epoch itself, so parse success can't be inferred from the value alone.
+	tsOK []bool
+
+	// durValues contains nanosecond durations parsed from values, e.g. "1.5s" or "-200ms".
+	durValues []int64
+
+	// durOK reports, per row, whether the corresponding durValues entry was actually
+	// parsed from a duration - a zero durValues entry is ambiguous with a literal
+	// zero duration such as "0s", so parse success can't be inferred from the value alone.
+	durOK []bool
 }
 
 // sortRowRef is the reference to a single log entry written to `sort` pipe.
@@ -165,8 +226,57 @@ func (c *sortBlockByColumn) getF64ValueAtRow(rowIdx int) float64 {
 	return c.f64Values[rowIdx]
 }
 
+// getTimestampValueAtRow returns the timestamp parsed from the value at rowIdx,
+// together with whether parsing actually succeeded for that row.
+func (c *sortBlockByColumn) getTimestampValueAtRow(rowIdx int) (int64, bool) {
+	if len(c.tsOK) == 0 {
+		return 0, false
+	}
+	if c.c.isConst {
+		return c.tsValues[0], c.tsOK[0]
+	}
+	return c.tsValues[rowIdx], c.tsOK[rowIdx]
+}
+
+// getDurationValueAtRow returns the duration parsed from the value at rowIdx,
+// together with whether parsing actually succeeded for that row.
+func (c *sortBlockByColumn) getDurationValueAtRow(rowIdx int) (int64, bool) {
+	if len(c.durOK) == 0 {
+		return 0, false
+	}
+	if c.c.isConst {
+		return c.durValues[0], c.durOK[0]
+	}
+	return c.durValues[rowIdx], c.durOK[rowIdx]
+}
+
 // writeBlock writes br to shard.
 func (shard *pipeSortProcessorShard) writeBlock(br *blockResult) {
+	blockIdx := shard.appendBlock(br)
+
+	if shard.ps.limit > 0 {
+		shard.writeBlockTopN(blockIdx)
+		return
+	}
+
+	// Add row references to rowRefs.
+	rowRefs := shard.rowRefs
+	rowRefsLen := len(rowRefs)
+	rowsCount := len(shard.blocks[blockIdx].br.timestamps)
+	for i := 0; i < rowsCount; i++ {
+		rowRefs = append(rowRefs, sortRowRef{
+			blockIdx: blockIdx,
+			rowIdx:   i,
+		})
+	}
+	shard.rowRefs = rowRefs
+	shard.stateSizeBudget -= (len(rowRefs) - rowRefsLen) * int(unsafe.Sizeof(rowRefs[0]))
+}
+
+// appendBlock clones br, splits its columns into byColumns/otherColumns according
+// to shard.ps.byFields and appends the result to shard.blocks. It returns the
+// index of the newly appended block inside shard.blocks.
+func (shard *pipeSortProcessorShard) appendBlock(br *blockResult) int {
 	// clone br, so it could be owned by shard
 	br = br.clone()
 	cs := br.getColumns()
@@ -222,12 +332,14 @@ func (shard *pipeSortProcessorShard) writeBlock(br *blockResult) {
 			bc := &byColumns[i]
 			bc.c = c
 
-			if c.isTime {
-				// Do not initialize bc.i64Values and bc.f64Values, since they aren't used.
-				// This saves some memory.
+			if c.isTime || bf.natural {
+				// Do not initialize bc.i64Values and bc.f64Values, since they aren't used:
+				// natural sorting always compares raw string values - see sortBlockLessRefs().
 				continue
 			}
 			if c.isConst {
+				bc.tsValues, bc.tsOK = shard.createTimestampValues(c.encodedValues)
+				bc.durValues, bc.durOK = shard.createDurationValues(c.encodedValues)
 				bc.i64Values = shard.createInt64Values(c.encodedValues)
 				bc.f64Values = shard.createFloat64Values(c.encodedValues)
 				continue
@@ -235,6 +347,8 @@ func (shard *pipeSortProcessorShard) writeBlock(br *blockResult) {
 
 			// pre-populate values in order to track better br memory usage
 			values := c.getValues(br)
+			bc.tsValues, bc.tsOK = shard.createTimestampValues(values)
+			bc.durValues, bc.durOK = shard.createDurationValues(values)
 			bc.i64Values = shard.createInt64Values(values)
 			bc.f64Values = shard.createFloat64Values(values)
 		}
@@ -267,18 +381,11 @@ func (shard *pipeSortProcessorShard) writeBlock(br *blockResult) {
 	shard.stateSizeBudget -= br.sizeBytes()
 	shard.stateSizeBudget -= int(unsafe.Sizeof(shard.blocks[0]))
 
-	// Add row references to rowRefs.
-	blockIdx := len(shard.blocks) - 1
-	rowRefs := shard.rowRefs
-	rowRefsLen := len(rowRefs)
-	for i := range br.timestamps {
-		rowRefs = append(rowRefs, sortRowRef{
-			blockIdx: blockIdx,
-			rowIdx:   i,
-		})
+	if shard.ps.limit > 0 {
+		shard.blockRefCounts = append(shard.blockRefCounts, 0)
 	}
-	shard.rowRefs = rowRefs
-	shard.stateSizeBudget -= (len(rowRefs) - rowRefsLen) * int(unsafe.Sizeof(rowRefs[0]))
+
+	return len(shard.blocks) - 1
 }
 
 func (shard *pipeSortProcessorShard) createInt64Values(values []string) []int64 {
@@ -291,8 +398,8 @@ func (shard *pipeSortProcessorShard) createInt64Values(values []string) []int64
 		}
 		u32, _ := tryParseIPv4(v)
 		a[i] = int64(u32)
-		// Do not try parsing timestamp and duration, since they may be negative.
-		// This breaks sorting.
+		// Timestamps and durations are handled separately in createTimestampValues()
+		// and createDurationValues(), since they may be negative.
 	}
 
 	shard.stateSizeBudget -= len(a) * int(unsafe.Sizeof(a[0]))
@@ -315,6 +422,48 @@ func (shard *pipeSortProcessorShard) createFloat64Values(values []string) []floa
 	return a
 }
 
+// createTimestampValues parses values as RFC3339 timestamps, returning the
+// corresponding unix nanosecond timestamp for every successfully parsed value
+// plus a parallel slice reporting which values actually parsed - a zero
+// timestamp is a legitimate value (the Unix epoch), so it can't be used
+// as a parse-failure sentinel.
+func (shard *pipeSortProcessorShard) createTimestampValues(values []string) ([]int64, []bool) {
+	a := make([]int64, len(values))
+	ok := make([]bool, len(values))
+	for i, v := range values {
+		ts, parsed := tryParseTimestampRFC3339Nano(v)
+		if parsed {
+			a[i] = ts
+			ok[i] = true
+		}
+	}
+
+	shard.stateSizeBudget -= len(a)*int(unsafe.Sizeof(a[0])) + len(ok)*int(unsafe.Sizeof(ok[0]))
+
+	return a, ok
+}
+
+// createDurationValues parses values as durations such as "1.5s" or "-200ms",
+// returning the corresponding number of nanoseconds for every successfully
+// parsed value plus a parallel slice reporting which values actually parsed -
+// a zero duration is a legitimate value (e.g. "0s"), so it can't be used as
+// a parse-failure sentinel.
+func (shard *pipeSortProcessorShard) createDurationValues(values []string) ([]int64, []bool) {
+	a := make([]int64, len(values))
+	ok := make([]bool, len(values))
+	for i, v := range values {
+		d, parsed := tryParseDuration(v)
+		if parsed {
+			a[i] = d
+			ok[i] = true
+		}
+	}
+
+	shard.stateSizeBudget -= len(a)*int(unsafe.Sizeof(a[0])) + len(ok)*int(unsafe.Sizeof(ok[0]))
+
+	return a, ok
+}
+
 func (shard *pipeSortProcessorShard) Len() int {
 	return len(shard.rowRefs)
 }
@@ -325,6 +474,16 @@ func (shard *pipeSortProcessorShard) Swap(i, j int) {
 }
 
 func (shard *pipeSortProcessorShard) Less(i, j int) bool {
+	if shard.sortStopCh != nil {
+		shard.sortCmpCount++
+		if shard.sortCmpCount%sortCancelCheckInterval == 0 {
+			select {
+			case <-shard.sortStopCh:
+				panic(errSortCancelled)
+			default:
+			}
+		}
+	}
 	return sortBlockLess(shard, i, shard, j)
 }
 
@@ -339,12 +498,17 @@ func (psp *pipeSortProcessor) writeBlock(workerID uint, br *blockResult) {
 		// steal some budget for the state size from the global budget.
 		remaining := psp.stateSizeBudget.Add(-stateSizeBudgetChunk)
 		if remaining < 0 {
-			// The state size is too big. Stop processing data in order to avoid OOM crash.
-			if remaining+stateSizeBudgetChunk >= 0 {
-				// Notify worker goroutines to stop calling writeBlock() in order to save CPU time.
+			// The global budget is exhausted. Instead of aborting the query with
+			// an out-of-memory error, spill this shard's accumulated rows to a
+			// temporary run file on disk and keep accepting new blocks into a
+			// fresh in-memory batch - see pipeSortProcessor.flush() for the merge side.
+			psp.stateSizeBudget.Add(stateSizeBudgetChunk)
+			if err := shard.spillToDisk(psp.stopCh); err != nil {
+				psp.spillErr.Store(err)
 				psp.cancel()
+				return
 			}
-			return
+			continue
 		}
 		shard.stateSizeBudget += stateSizeBudgetChunk
 	}
@@ -353,8 +517,20 @@ func (psp *pipeSortProcessor) writeBlock(workerID uint, br *blockResult) {
 }
 
 func (psp *pipeSortProcessor) flush() error {
-	if n := psp.stateSizeBudget.Load(); n <= 0 {
-		return fmt.Errorf("cannot calculate [%s], since it requires more than %dMB of memory", psp.ps.String(), psp.maxStateSize/(1<<20))
+	// Make sure every run file spilled to disk by writeBlock()/spillToDisk() is removed
+	// once the query finishes, regardless of which return path below is taken - including
+	// the early returns for a spill error or a closed stopCh, which never reach the merge
+	// loop that would otherwise open and remove them via runSources.
+	defer func() {
+		for i := range psp.shards {
+			for _, path := range psp.shards[i].runPaths {
+				_ = os.Remove(path)
+			}
+		}
+	}()
+
+	if errv := psp.spillErr.Load(); errv != nil {
+		return errv.(error)
 	}
 
 	select {
@@ -365,30 +541,53 @@ func (psp *pipeSortProcessor) flush() error {
 
 	// Sort every shard in parallel
 	var wg sync.WaitGroup
+	var cancelled atomic.Bool
 	shards := psp.shards
 	for i := range shards {
 		wg.Add(1)
 		go func(shard *pipeSortProcessorShard) {
-			// TODO: interrupt long sorting when psp.stopCh is closed.
-			sort.Sort(shard)
-			wg.Done()
+			defer wg.Done()
+			if !sortShardCancellable(shard, psp.stopCh) {
+				cancelled.Store(true)
+			}
 		}(&shards[i])
 	}
 	wg.Wait()
 
+	if cancelled.Load() {
+		return nil
+	}
+
 	select {
 	case <-psp.stopCh:
 		return nil
 	default:
 	}
 
-	// Merge sorted results across shards
+	// Merge sorted results across shards, together with every run file spilled to disk.
+	var runSources []*sortRunSource
+	defer func() {
+		for _, rs := range runSources {
+			rs.mustClose()
+		}
+	}()
+
 	sh := pipeSortProcessorShardsHeap(make([]*pipeSortProcessorShard, 0, len(shards)))
 	for i := range shards {
 		shard := &shards[i]
 		if shard.Len() > 0 {
 			sh = append(sh, shard)
 		}
+		for _, path := range shard.runPaths {
+			runShard, rs, err := newSortRunSource(psp.ps, path)
+			if err != nil {
+				return fmt.Errorf("cannot read temporary run file %q spilled while calculating [%s]: %w", path, psp.ps.String(), err)
+			}
+			runSources = append(runSources, rs)
+			if runShard != nil {
+				sh = append(sh, runShard)
+			}
+		}
 	}
 	if len(sh) == 0 {
 		return nil
@@ -402,20 +601,25 @@ func (psp *pipeSortProcessor) flush() error {
 	var shardNext *pipeSortProcessorShard
 
 	for len(sh) > 1 {
+		select {
+		case <-psp.stopCh:
+			return nil
+		default:
+		}
+
 		shard := sh[0]
 		wctx.writeRow(shard, shard.rowRefNext)
 		shard.rowRefNext++
 
 		if shard.rowRefNext >= len(shard.rowRefs) {
-			_ = heap.Pop(&sh)
-			shardNext = nil
-
-			select {
-			case <-psp.stopCh:
-				return nil
-			default:
+			if shard.refill() {
+				heap.Fix(&sh, 0)
+				shardNext = nil
+				continue
 			}
 
+			_ = heap.Pop(&sh)
+			shardNext = nil
 			continue
 		}
 
@@ -429,19 +633,24 @@ func (psp *pipeSortProcessor) flush() error {
 		if sortBlockLess(shardNext, shardNext.rowRefNext, shard, shard.rowRefNext) {
 			heap.Fix(&sh, 0)
 			shardNext = nil
-
+		}
+	}
+	if len(sh) == 1 {
+		shard := sh[0]
+		for {
 			select {
 			case <-psp.stopCh:
 				return nil
 			default:
 			}
-		}
-	}
-	if len(sh) == 1 {
-		shard := sh[0]
-		for shard.rowRefNext < len(shard.rowRefs) {
-			wctx.writeRow(shard, shard.rowRefNext)
-			shard.rowRefNext++
+
+			for shard.rowRefNext < len(shard.rowRefs) {
+				wctx.writeRow(shard, shard.rowRefNext)
+				shard.rowRefNext++
+			}
+			if !shard.refill() {
+				break
+			}
 		}
 	}
 	wctx.flush()
@@ -561,10 +770,18 @@ func (sh *pipeSortProcessorShardsHeap) Pop() any {
 }
 
 func sortBlockLess(shardA *pipeSortProcessorShard, rowIdxA int, shardB *pipeSortProcessorShard, rowIdxB int) bool {
-	byFields := shardA.ps.byFields
-
 	rrA := shardA.rowRefs[rowIdxA]
 	rrB := shardB.rowRefs[rowIdxB]
+	return sortBlockLessRefs(shardA, rrA, shardB, rrB)
+}
+
+// sortBlockLessRefs is the same as sortBlockLess, but it accepts row references
+// directly instead of positions inside shardA.rowRefs/shardB.rowRefs. This allows
+// comparing a candidate row that hasn't been appended to rowRefs yet -
+// see pipeSortProcessorShard.writeBlockTopN().
+func sortBlockLessRefs(shardA *pipeSortProcessorShard, rrA sortRowRef, shardB *pipeSortProcessorShard, rrB sortRowRef) bool {
+	byFields := shardA.ps.byFields
+
 	bA := &shardA.blocks[rrA.blockIdx]
 	bB := &shardB.blocks[rrB.blockIdx]
 	for idx := range bA.byColumns {
@@ -575,6 +792,21 @@ func sortBlockLess(shardA *pipeSortProcessorShard, rowIdxA int, shardB *pipeSort
 			isDesc = !isDesc
 		}
 
+		if len(byFields) > idx && byFields[idx].natural {
+			// Natural (version-aware) sorting explicitly requested for this field -
+			// skip the int64/float64 fast paths, since e.g. "pod-2" and "pod-10"
+			// must be compared digit-run-wise instead of as a whole number.
+			sA := cA.c.getValueAtRow(bA.br, rrA.rowIdx)
+			sB := cB.c.getValueAtRow(bB.br, rrB.rowIdx)
+			if sA == sB {
+				continue
+			}
+			if isDesc {
+				return naturalLess(sB, sA)
+			}
+			return naturalLess(sA, sB)
+		}
+
 		if cA.c.isConst && cB.c.isConst {
 			// Fast path - compare const values
 			ccA := cA.c.encodedValues[0]
@@ -606,7 +838,35 @@ func sortBlockLess(shardA *pipeSortProcessorShard, rowIdxA int, shardB *pipeSort
 			return false
 		}
 
-		// Try sorting by int64 values at first
+		// Try sorting by values parsed as RFC3339 timestamps next (e.g. "2024-01-02T03:04:05Z"),
+		// since they carry more sorting-relevant precision than a plain int64/string comparison.
+		tsA, tsOkA := cA.getTimestampValueAtRow(rrA.rowIdx)
+		tsB, tsOkB := cB.getTimestampValueAtRow(rrB.rowIdx)
+		if tsOkA && tsOkB {
+			if tsA == tsB {
+				continue
+			}
+			if isDesc {
+				return tsB < tsA
+			}
+			return tsA < tsB
+		}
+
+		// Then try sorting by values parsed as durations (e.g. "1.5s", "-200ms"),
+		// comparing their signed nanosecond values.
+		durA, durOkA := cA.getDurationValueAtRow(rrA.rowIdx)
+		durB, durOkB := cB.getDurationValueAtRow(rrB.rowIdx)
+		if durOkA && durOkB {
+			if durA == durB {
+				continue
+			}
+			if isDesc {
+				return durB < durA
+			}
+			return durA < durB
+		}
+
+		// Then try sorting by plain int64 values
 		uA := cA.getI64ValueAtRow(rrA.rowIdx)
 		uB := cB.getI64ValueAtRow(rrB.rowIdx)
 		if uA != 0 && uB != 0 {
@@ -677,10 +937,18 @@ type bySortField struct {
 
 	// whether the sorting for the given field in descending order
 	isDesc bool
+
+	// whether to apply natural (version-aware) sorting to the field,
+	// e.g. compare "pod-2" and "pod-10" by splitting them into digit
+	// and non-digit runs instead of comparing them as opaque strings.
+	natural bool
 }
 
 func (bf *bySortField) String() string {
 	s := quoteTokenIfNeeded(bf.name)
+	if bf.natural {
+		s += " natural"
+	}
 	if bf.isDesc {
 		s += " desc"
 	}
@@ -705,6 +973,10 @@ func parseBySortFields(lex *lexer) ([]*bySortField, error) {
 		bf := &bySortField{
 			name: fieldName,
 		}
+		if lex.isKeyword("natural") {
+			lex.nextToken()
+			bf.natural = true
+		}
 		if lex.isKeyword("desc") {
 			lex.nextToken()
 			bf.isDesc = true
@@ -0,0 +1,42 @@
+package logstorage
+
+import (
+	"errors"
+	"sort"
+)
+
+// sortCancelCheckInterval is the number of Less() comparator calls between two
+// consecutive checks of the stopCh passed to sortShardCancellable(). Checking on
+// every single comparison would slow down sorting noticeably, while checking too
+// rarely would make cancellation unresponsive on a huge shard.
+const sortCancelCheckInterval = 4096
+
+// errSortCancelled is used to unwind sort.Sort() via panic/recover once stopCh
+// passed to sortShardCancellable() is closed mid-sort.
+var errSortCancelled = errors.New("sort cancelled")
+
+// sortShardCancellable sorts shard like sort.Sort(shard), but periodically checks
+// stopCh from the Less() comparator, so a huge in-progress sort can be interrupted
+// instead of running to completion after the query has already been cancelled.
+//
+// It returns false if the sort was interrupted; in that case shard.rowRefs is left
+// in an unspecified (possibly partially sorted) order.
+func sortShardCancellable(shard *pipeSortProcessorShard, stopCh <-chan struct{}) (completed bool) {
+	shard.sortStopCh = stopCh
+	shard.sortCmpCount = 0
+
+	defer func() {
+		shard.sortStopCh = nil
+
+		if r := recover(); r != nil {
+			if r == errSortCancelled { //nolint:errorlint // panic value is always errSortCancelled here
+				completed = false
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	sort.Sort(shard)
+	return true
+}
@@ -0,0 +1,57 @@
+package logstorage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSortShardCancellable(t *testing.T) {
+	const rowsCount = 200_000
+
+	ps := &pipeSort{
+		byFields: []*bySortField{
+			{name: "x"},
+		},
+	}
+
+	shard := &pipeSortProcessorShard{}
+	shard.ps = ps
+
+	// Populate the shard with a huge number of rows in reverse order, so sorting
+	// them requires a non-trivial amount of comparisons.
+	for i := 0; i < rowsCount; i++ {
+		v := strconv.Itoa(rowsCount - i)
+		shard.blocks = append(shard.blocks, sortBlock{
+			byColumns: []sortBlockByColumn{
+				{
+					c: &blockResultColumn{
+						isConst:       true,
+						encodedValues: []string{v},
+					},
+				},
+			},
+		})
+		shard.rowRefs = append(shard.rowRefs, sortRowRef{
+			blockIdx: i,
+			rowIdx:   0,
+		})
+	}
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+
+	resultCh := make(chan bool, 1)
+	go func() {
+		resultCh <- sortShardCancellable(shard, stopCh)
+	}()
+
+	select {
+	case completed := <-resultCh:
+		if completed {
+			t.Fatalf("unexpected successful sort completion after stopCh has been closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("sortShardCancellable didn't return in time after stopCh was closed")
+	}
+}
@@ -0,0 +1,32 @@
+package logstorage
+
+import (
+	"time"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promutils"
+)
+
+// tryParseTimestampRFC3339Nano attempts to parse s as an RFC3339 timestamp such as
+// "2024-01-02T03:04:05Z" or "2024-01-02T03:04:05.123456789+02:00", returning the
+// corresponding unix nanosecond timestamp.
+func tryParseTimestampRFC3339Nano(s string) (int64, bool) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, false
+		}
+	}
+	return t.UnixNano(), true
+}
+
+// tryParseDuration attempts to parse s as a duration such as "1.5s" or "-200ms",
+// returning the corresponding number of nanoseconds. Unlike createInt64Values(),
+// this correctly handles negative durations.
+func tryParseDuration(s string) (int64, bool) {
+	d, err := promutils.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return int64(d), true
+}
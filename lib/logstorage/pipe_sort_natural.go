@@ -0,0 +1,55 @@
+package logstorage
+
+import "strings"
+
+// naturalLess compares a and b using natural (a.k.a. "version") sort order: the
+// strings are split into alternating runs of non-digit and digit characters,
+// non-digit runs are compared bytewise and digit runs are compared numerically,
+// so that e.g. "pod-2" sorts before "pod-10" instead of after it.
+//
+// Equal-magnitude digit runs that differ only in the number of leading zeros
+// (e.g. "007" vs "7") fall back to a lexicographic comparison of the raw digit
+// run, so the ordering stays deterministic.
+func naturalLess(a, b string) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		ca, cb := a[i], b[j]
+		if isASCIIDigit(ca) && isASCIIDigit(cb) {
+			si, sj := i, j
+			for i < len(a) && isASCIIDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isASCIIDigit(b[j]) {
+				j++
+			}
+			numA := a[si:i]
+			numB := b[sj:j]
+
+			magA := strings.TrimLeft(numA, "0")
+			magB := strings.TrimLeft(numB, "0")
+			if len(magA) != len(magB) {
+				return len(magA) < len(magB)
+			}
+			if magA != magB {
+				return magA < magB
+			}
+			// Equal magnitude - preserve a deterministic order for differing
+			// leading-zero counts by falling back to a lexicographic comparison.
+			if numA != numB {
+				return numA < numB
+			}
+			continue
+		}
+
+		if ca != cb {
+			return ca < cb
+		}
+		i++
+		j++
+	}
+	return i >= len(a) && j < len(b)
+}
+
+func isASCIIDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
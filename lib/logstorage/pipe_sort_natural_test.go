@@ -0,0 +1,43 @@
+package logstorage
+
+import (
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	f := func(a, b string, want bool) {
+		t.Helper()
+		if got := naturalLess(a, b); got != want {
+			t.Fatalf("naturalLess(%q, %q) = %v; want %v", a, b, got, want)
+		}
+	}
+
+	// Equal strings are never less than each other.
+	f("", "", false)
+	f("foo", "foo", false)
+
+	// Plain lexicographic comparison when there are no digit runs.
+	f("abc", "abd", true)
+	f("abd", "abc", false)
+
+	// Numeric digit runs compare by magnitude, not lexicographically.
+	f("pod-2", "pod-10", true)
+	f("pod-10", "pod-2", false)
+	f("v1.9.0", "v1.10.0", true)
+	f("v1.10.0", "v1.9.0", false)
+
+	// Equal magnitude, differing leading zeros: deterministic lexicographic tie-break
+	// on the raw digit run, so "007" (starting with '0') sorts before "7".
+	f("007", "7", true)
+	f("7", "007", false)
+	f("007", "007", false)
+
+	// Mixed-length digit runs interleaved with non-digit runs.
+	f("item9", "item10", true)
+	f("item10", "item9", false)
+	f("a1b2", "a1b10", true)
+
+	// A shorter string that is a strict prefix of a longer one sorts first.
+	f("pod", "pod-1", true)
+	f("pod-1", "pod", false)
+}
@@ -0,0 +1,17 @@
+package logstorage
+
+// optimizePipeSortLimit folds a '| limit N' pipe immediately following
+// '| sort by (...)' into the sort pipe itself, by setting ps.limit = pl.limit.
+//
+// This lets pipeSortProcessorShard keep only the top N rows in a bounded heap
+// per shard (see writeBlockTopN()) instead of buffering and sorting the whole
+// result set, for the common 'sort by (...) | limit N' query shape.
+//
+// This is the detection/folding logic only. The pipe chain construction code
+// is responsible for calling this for every adjacent (pipeSort, pipeLimit)
+// pair it finds and for then dropping the now-redundant pipeLimit from the
+// chain, the same way it already drops other pipes made redundant by fusing
+// them into a neighbor.
+func optimizePipeSortLimit(ps *pipeSort, pl *pipeLimit) {
+	ps.limit = pl.limit
+}
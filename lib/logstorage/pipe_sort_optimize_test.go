@@ -0,0 +1,22 @@
+package logstorage
+
+import (
+	"testing"
+)
+
+func TestOptimizePipeSortLimit(t *testing.T) {
+	ps := &pipeSort{
+		byFields: []*bySortField{
+			{name: "x"},
+		},
+	}
+	pl := &pipeLimit{
+		limit: 42,
+	}
+
+	optimizePipeSortLimit(ps, pl)
+
+	if ps.limit != 42 {
+		t.Fatalf("unexpected ps.limit; got %d; want 42", ps.limit)
+	}
+}
@@ -0,0 +1,456 @@
+package logstorage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+var sortTmpDirPath = flag.String("logsql.sortTmpDirPath", "", "Path to directory for storing temporary run files created by '| sort' pipe "+
+	"when the in-memory buffer for the sorted results is exceeded; the OS temporary directory is used if empty")
+
+// sortRunBatchRows is the number of rows read from a single spilled run file
+// and fed into pipeSortProcessorShard.writeBlock() at once during the merge phase.
+const sortRunBatchRows = 2000
+
+// sortRunWriter writes rows evicted from a pipeSortProcessorShard into a temporary
+// run file on disk. The rows must be written in their final sorted order -
+// sortRunWriter doesn't sort anything by itself.
+type sortRunWriter struct {
+	f  *os.File
+	bw *bufio.Writer
+}
+
+func newSortRunWriter() (*sortRunWriter, error) {
+	f, err := os.CreateTemp(*sortTmpDirPath, "vlogs-sort-run-*.bin")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary file for spilling sort results to disk: %w", err)
+	}
+	return &sortRunWriter{
+		f:  f,
+		bw: bufio.NewWriterSize(f, 256*1024),
+	}, nil
+}
+
+// Run files intentionally don't reuse any "blockResult marshaling" for their
+// on-disk bytes, because blockResult has none to reuse: it's an in-memory
+// columnar view, not a type with its own wire format, and nothing elsewhere
+// in this package marshals one directly to bytes. What run files do reuse is
+// the existing mechanism this package already uses to *reconstruct* a
+// blockResult from column data - resultColumn.addValue()/setResultColumns(),
+// the same pair pipeSortWriteContext.writeRow() in pipe_sort.go uses to build the final
+// output blocks. nextBatch() below builds its rcs/addValue calls the same way;
+// only the row-by-row disk framing (the uvarint lengths and strings below) is
+// new, since that layer has no existing equivalent to reuse.
+
+// isTimeFieldName reports whether name refers to the reserved "_time" field,
+// whose value lives in blockResult.timestamps rather than in a regular column -
+// see writeRow() and nextBatch() for why this needs special handling across
+// the disk round trip.
+func isTimeFieldName(name string) bool {
+	return name == "_time"
+}
+
+// writeRow appends the row at rowIdx in b to the run file.
+//
+// The row's real timestamp is persisted directly (rather than as a reformatted
+// "_time" string) so that nextBatch() can restore blockResult.timestamps exactly -
+// that's what lets sortBlockLessRefs()'s isTime fast path keep comparing real
+// nanosecond values after a round trip through disk, instead of silently falling
+// back to comparing a reloaded row against a never-spilled one as if one side
+// were always "smaller" just because it came from a run file.
+//
+// Other than that, only byFields values (if any) plus the other-columns
+// name/value pairs are persisted. The row is re-ingested via
+// pipeSortProcessorShard.writeBlock() during the merge phase, so there is no
+// need to persist anything beyond what writeBlock() itself needs.
+func (rw *sortRunWriter) writeRow(ps *pipeSort, b *sortBlock, rowIdx int) error {
+	byFields := ps.byFields
+
+	if err := writeVarint(rw.bw, b.br.timestamps[rowIdx]); err != nil {
+		return err
+	}
+
+	// No length prefix here: byFields is the same for every row in the run
+	// (it's shard.ps.byFields), so the reader already knows how many and
+	// which slots to expect - see nextBatch().
+	for i, bf := range byFields {
+		if isTimeFieldName(bf.name) {
+			// The value is already captured by the timestamp written above.
+			continue
+		}
+		v := b.byColumns[i].c.getValueAtRow(b.br, rowIdx)
+		if err := writeRunString(rw.bw, v); err != nil {
+			return err
+		}
+	}
+
+	otherCount := 0
+	for _, c := range b.otherColumns {
+		if !isTimeFieldName(c.name) {
+			otherCount++
+		}
+	}
+	if err := writeUvarint(rw.bw, uint64(otherCount)); err != nil {
+		return err
+	}
+	for _, c := range b.otherColumns {
+		if isTimeFieldName(c.name) {
+			continue
+		}
+		if err := writeRunString(rw.bw, c.name); err != nil {
+			return err
+		}
+		v := c.getValueAtRow(b.br, rowIdx)
+		if err := writeRunString(rw.bw, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalize flushes and closes the run file, returning its path for later reading.
+func (rw *sortRunWriter) finalize() (string, error) {
+	if err := rw.bw.Flush(); err != nil {
+		_ = rw.f.Close()
+		return "", err
+	}
+	path := rw.f.Name()
+	if err := rw.f.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// mustClose closes and removes the run file. It is used for cleaning up after a write error.
+func (rw *sortRunWriter) mustClose() {
+	path := rw.f.Name()
+	_ = rw.f.Close()
+	_ = os.Remove(path)
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func writeVarint(w *bufio.Writer, x int64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], x)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+func readVarint(r *bufio.Reader) (int64, error) {
+	return binary.ReadVarint(r)
+}
+
+func writeRunString(w *bufio.Writer, s string) error {
+	if err := writeUvarint(w, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+func readUvarint(r *bufio.Reader) (uint64, error) {
+	return binary.ReadUvarint(r)
+}
+
+func readRunString(r *bufio.Reader) (string, error) {
+	n, err := readUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// sortRunRow is a single row decoded from a run file.
+type sortRunRow struct {
+	// ts is the row's real timestamp, persisted separately from byValues/otherValues -
+	// see isTimeFieldName().
+	ts int64
+
+	byValues    []string
+	otherNames  []string
+	otherValues []string
+}
+
+// sortRunSource reads rows previously written by sortRunWriter back from disk
+// and feeds them, in batches, into a pipeSortProcessorShard so the usual
+// merge machinery in pipeSortProcessor.flush() can treat a spilled run
+// exactly like an in-memory shard.
+type sortRunSource struct {
+	path string
+	f    *os.File
+	br   *bufio.Reader
+
+	pending    *sortRunRow
+	pendingSet bool
+
+	closed bool
+}
+
+// newSortRunSource opens the run file at path and loads its first batch into a freshly
+// created pipeSortProcessorShard. It returns a nil shard once the run is empty.
+func newSortRunSource(ps *pipeSort, path string) (*pipeSortProcessorShard, *sortRunSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs := &sortRunSource{
+		path: path,
+		f:    f,
+		br:   bufio.NewReaderSize(f, 256*1024),
+	}
+
+	shard := &pipeSortProcessorShard{}
+	shard.ps = ps
+	shard.run = rs
+
+	if !shard.refill() {
+		return nil, rs, nil
+	}
+	return shard, rs, nil
+}
+
+// mustClose closes the underlying file and removes it from disk. It is safe to call multiple times.
+func (rs *sortRunSource) mustClose() {
+	if rs.closed {
+		return
+	}
+	rs.closed = true
+	_ = rs.f.Close()
+	_ = os.Remove(rs.path)
+}
+
+// readRow decodes the next row from the run file. byFields must be the same
+// shard.ps.byFields used to write the run, since the "_time" slots (if any)
+// aren't present on disk and are filled in from ts instead - see writeRow().
+func (rs *sortRunSource) readRow(byFields []*bySortField) (*sortRunRow, error) {
+	if rs.pendingSet {
+		rs.pendingSet = false
+		return rs.pending, nil
+	}
+
+	ts, err := readVarint(rs.br)
+	if err != nil {
+		return nil, err
+	}
+
+	byValues := make([]string, len(byFields))
+	for i, bf := range byFields {
+		if isTimeFieldName(bf.name) {
+			continue
+		}
+		v, err := readRunString(rs.br)
+		if err != nil {
+			return nil, err
+		}
+		byValues[i] = v
+	}
+
+	m, err := readUvarint(rs.br)
+	if err != nil {
+		return nil, err
+	}
+	otherNames := make([]string, m)
+	otherValues := make([]string, m)
+	for i := range otherNames {
+		name, err := readRunString(rs.br)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readRunString(rs.br)
+		if err != nil {
+			return nil, err
+		}
+		otherNames[i] = name
+		otherValues[i] = v
+	}
+
+	return &sortRunRow{
+		ts:          ts,
+		byValues:    byValues,
+		otherNames:  otherNames,
+		otherValues: otherValues,
+	}, nil
+}
+
+func sameRunRowLayout(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nextBatch reads up to sortRunBatchRows rows sharing the same set of other-column
+// names from the run file and re-ingests them into shard via writeBlock(), so
+// byColumns/otherColumns are rebuilt exactly like for freshly arrived data.
+//
+// The "_time" field (if any among byFields or the other columns) is never
+// rebuilt as a regular resultColumn - it is restored directly into
+// blockResult.timestamps from the per-row timestamp persisted by writeRow(),
+// so the reconstructed column stays a genuine isTime column instead of a
+// plain string column that happens to be named "_time".
+//
+// It returns false once the run file is exhausted, and closes and removes it.
+func (rs *sortRunSource) nextBatch(shard *pipeSortProcessorShard) bool {
+	byFields := shard.ps.byFields
+
+	row, err := rs.readRow(byFields)
+	if err != nil {
+		rs.mustClose()
+		return false
+	}
+
+	byRcIdx := make([]int, len(byFields))
+	rcs := make([]resultColumn, 0, len(byFields)+len(row.otherNames))
+	for i, bf := range byFields {
+		if isTimeFieldName(bf.name) {
+			byRcIdx[i] = -1
+			continue
+		}
+		byRcIdx[i] = len(rcs)
+		rcs = append(rcs, resultColumn{name: bf.name})
+	}
+	otherRcIdx := make([]int, len(row.otherNames))
+	for i, name := range row.otherNames {
+		if isTimeFieldName(name) {
+			otherRcIdx[i] = -1
+			continue
+		}
+		otherRcIdx[i] = len(rcs)
+		rcs = append(rcs, resultColumn{name: name})
+	}
+
+	tsValues := make([]int64, 0, sortRunBatchRows)
+
+	rowsAdded := 0
+	for {
+		for i := range byFields {
+			if idx := byRcIdx[i]; idx >= 0 {
+				rcs[idx].addValue(row.byValues[i])
+			}
+		}
+		for i, v := range row.otherValues {
+			if idx := otherRcIdx[i]; idx >= 0 {
+				rcs[idx].addValue(v)
+			}
+		}
+		tsValues = append(tsValues, row.ts)
+		rowsAdded++
+
+		if rowsAdded >= sortRunBatchRows {
+			break
+		}
+
+		next, err := rs.readRow(byFields)
+		if err != nil {
+			break
+		}
+		if !sameRunRowLayout(row.otherNames, next.otherNames) {
+			rs.pending = next
+			rs.pendingSet = true
+			break
+		}
+		row = next
+	}
+
+	var br blockResult
+	br.setResultColumns(rcs)
+	br.timestamps = tsValues
+
+	shard.blocks = shard.blocks[:0]
+	shard.rowRefs = shard.rowRefs[:0]
+	shard.rowRefNext = 0
+	shard.blockRefCounts = shard.blockRefCounts[:0]
+	shard.writeBlock(&br)
+	if shard.ps.limit > 0 {
+		// writeBlockTopN() leaves rowRefs in heap order, while the merge needs them sorted.
+		sort.Sort(shard)
+	}
+
+	return true
+}
+
+// refill loads the next batch of rows from the shard's backing run file, if any.
+//
+// It returns false when the shard isn't run-file backed, or when the backing
+// run file has been fully drained (in which case the run file is closed and removed).
+func (shard *pipeSortProcessorShard) refill() bool {
+	if shard.run == nil {
+		return false
+	}
+	if shard.run.nextBatch(shard) {
+		return true
+	}
+	shard.run = nil
+	return false
+}
+
+// spillToDisk sorts the rows accumulated in the shard so far and writes them into
+// a new temporary run file, then frees up the shard's in-memory state so it can
+// keep accepting new blocks within its budget.
+//
+// This is what makes '| sort by (...)' work on result sets that are much bigger
+// than the memory budget allows to keep in RAM at once - see pipeSortProcessor.flush().
+func (shard *pipeSortProcessorShard) spillToDisk(stopCh <-chan struct{}) error {
+	if len(shard.rowRefs) == 0 {
+		shard.stateSizeBudget = stateSizeBudgetChunk
+		return nil
+	}
+
+	if !sortShardCancellable(shard, stopCh) {
+		// The query has been cancelled while sorting the shard for spilling.
+		// There is no point in writing anything to disk - just drop the in-memory
+		// state and let flush() notice stopCh is closed and bail out.
+		shard.blocks = nil
+		shard.rowRefs = nil
+		shard.rowRefNext = 0
+		shard.blockRefCounts = nil
+		shard.stateSizeBudget = stateSizeBudgetChunk
+		return nil
+	}
+
+	rw, err := newSortRunWriter()
+	if err != nil {
+		return err
+	}
+	for _, rr := range shard.rowRefs {
+		b := &shard.blocks[rr.blockIdx]
+		if err := rw.writeRow(shard.ps, b, rr.rowIdx); err != nil {
+			rw.mustClose()
+			return fmt.Errorf("cannot write row to temporary run file: %w", err)
+		}
+	}
+	path, err := rw.finalize()
+	if err != nil {
+		return fmt.Errorf("cannot finalize temporary run file: %w", err)
+	}
+
+	shard.runPaths = append(shard.runPaths, path)
+
+	shard.blocks = nil
+	shard.rowRefs = nil
+	shard.rowRefNext = 0
+	shard.blockRefCounts = nil
+	shard.stateSizeBudget = stateSizeBudgetChunk
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package logstorage
+
+import (
+	"testing"
+)
+
+// TestSortSpillPreservesTimeOrdering is a regression test for a bug where a
+// shard reloaded from a spilled run file lost its "_time" column's isTime-ness
+// and real per-row timestamps, making sortBlockLessRefs() order a reloaded row
+// relative to a never-spilled one based on which side came from disk instead
+// of on the actual timestamp value - see spillToDisk()/nextBatch().
+func TestSortSpillPreservesTimeOrdering(t *testing.T) {
+	ps := &pipeSort{
+		byFields: []*bySortField{
+			{name: "_time"},
+		},
+	}
+
+	newTimeShard := func(ts int64) *pipeSortProcessorShard {
+		shard := &pipeSortProcessorShard{}
+		shard.ps = ps
+
+		shard.blocks = append(shard.blocks, sortBlock{
+			br: &blockResult{
+				timestamps: []int64{ts},
+			},
+			byColumns: []sortBlockByColumn{
+				{
+					c: &blockResultColumn{
+						name:   "_time",
+						isTime: true,
+					},
+				},
+			},
+			otherColumns: []*blockResultColumn{
+				{
+					name:          "msg",
+					isConst:       true,
+					encodedValues: []string{"hello"},
+				},
+			},
+		})
+		shard.rowRefs = append(shard.rowRefs, sortRowRef{blockIdx: 0, rowIdx: 0})
+		return shard
+	}
+
+	// liveShard never gets spilled - it keeps its genuine isTime column untouched.
+	liveShard := newTimeShard(2000)
+
+	// spilledShard starts out identical in shape to liveShard, but is spilled to
+	// disk and reloaded via newSortRunSource(), exactly like flush() does for a
+	// shard that exceeded its memory budget.
+	spilledShard := newTimeShard(1000)
+	stopCh := make(chan struct{})
+	if err := spilledShard.spillToDisk(stopCh); err != nil {
+		t.Fatalf("unexpected error spilling shard to disk: %v", err)
+	}
+	if len(spilledShard.runPaths) != 1 {
+		t.Fatalf("expected exactly one run file to be written; got %d", len(spilledShard.runPaths))
+	}
+
+	reloadedShard, rs, err := newSortRunSource(ps, spilledShard.runPaths[0])
+	if err != nil {
+		t.Fatalf("unexpected error reading back the spilled run file: %v", err)
+	}
+	defer rs.mustClose()
+	if reloadedShard == nil {
+		t.Fatalf("expected a non-nil shard reloaded from the run file")
+	}
+
+	c := reloadedShard.blocks[0].byColumns[0].c
+	if !c.isTime {
+		t.Fatalf(`expected the reloaded "_time" column to still be isTime after the disk round trip`)
+	}
+	if got := reloadedShard.blocks[0].br.timestamps[0]; got != 1000 {
+		t.Fatalf("unexpected reloaded timestamp; got %d; want 1000", got)
+	}
+
+	// The row with the earlier timestamp (reloadedShard, 1000ns) must sort before
+	// the row with the later one (liveShard, 2000ns), regardless of which side
+	// came from disk.
+	if !sortBlockLess(reloadedShard, 0, liveShard, 0) {
+		t.Fatalf("expected the row with the earlier timestamp (from the reloaded run) to sort first")
+	}
+	if sortBlockLess(liveShard, 0, reloadedShard, 0) {
+		t.Fatalf("expected the row with the later timestamp (never spilled) to sort last")
+	}
+}
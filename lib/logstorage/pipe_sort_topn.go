@@ -0,0 +1,145 @@
+package logstorage
+
+import (
+	"container/heap"
+)
+
+// writeBlockTopN feeds the rows of the block at shard.blocks[blockIdx] into shard's
+// bounded max-heap of size shard.ps.limit, keeping only the rows that belong to the
+// final top-N result instead of buffering every row seen so far.
+//
+// This turns '| sort by (...) [desc] | limit N' into an O(rows*log N) memory-bounded
+// operation instead of materializing and sorting the whole result set.
+func (shard *pipeSortProcessorShard) writeBlockTopN(blockIdx int) {
+	limit := shard.ps.limit
+	rowsCount := len(shard.blocks[blockIdx].br.timestamps)
+
+	h := (*sortTopNHeap)(shard)
+	for rowIdx := 0; rowIdx < rowsCount; rowIdx++ {
+		rr := sortRowRef{
+			blockIdx: blockIdx,
+			rowIdx:   rowIdx,
+		}
+		if uint64(len(shard.rowRefs)) < limit {
+			heap.Push(h, rr)
+			continue
+		}
+		if !sortBlockLessRefs(shard, rr, shard, shard.rowRefs[0]) {
+			// rr doesn't belong to the top-N window - drop it.
+			continue
+		}
+		// Count the new reference before dropping the evicted one, so a block isn't freed
+		// when rr replaces the last kept row of that same block.
+		shard.blockRefCounts[rr.blockIdx]++
+		evictedBlockIdx := shard.rowRefs[0].blockIdx
+		shard.blockRefCounts[evictedBlockIdx]--
+		if shard.blockRefCounts[evictedBlockIdx] == 0 {
+			shard.freeBlock(evictedBlockIdx)
+		}
+		shard.rowRefs[0] = rr
+		heap.Fix(h, 0)
+	}
+
+	if shard.blockRefCounts[blockIdx] == 0 {
+		// None of the rows from this block made it into the top-N window -
+		// drop the block right away instead of waiting for the next pruning pass.
+		shard.freeBlock(blockIdx)
+	}
+
+	shard.pruneEmptyBlocks()
+}
+
+// sortTopNHeap presents shard.rowRefs as a max-heap, in terms of the desired sort
+// order, so that heap[0] is always the worst-ranked row currently kept - the first
+// one to be evicted once a better row arrives.
+type sortTopNHeap pipeSortProcessorShard
+
+func (h *sortTopNHeap) Len() int {
+	return len(h.rowRefs)
+}
+
+func (h *sortTopNHeap) Swap(i, j int) {
+	h.rowRefs[i], h.rowRefs[j] = h.rowRefs[j], h.rowRefs[i]
+}
+
+func (h *sortTopNHeap) Less(i, j int) bool {
+	// Inverted compared to the regular ascending order, so Pop()/heap root
+	// return the row that sorts last among the currently kept rows.
+	shard := (*pipeSortProcessorShard)(h)
+	return sortBlockLessRefs(shard, shard.rowRefs[j], shard, shard.rowRefs[i])
+}
+
+func (h *sortTopNHeap) Push(x any) {
+	rr := x.(sortRowRef)
+	h.rowRefs = append(h.rowRefs, rr)
+	h.blockRefCounts[rr.blockIdx]++
+}
+
+func (h *sortTopNHeap) Pop() any {
+	rowRefs := h.rowRefs
+	n := len(rowRefs)
+	rr := rowRefs[n-1]
+	h.rowRefs = rowRefs[:n-1]
+	return rr
+}
+
+// freeBlock releases the memory held by an evicted block, since none of its rows
+// are referenced by shard.rowRefs any more, and credits its size back to the
+// shard's state size budget.
+func (shard *pipeSortProcessorShard) freeBlock(blockIdx int) {
+	b := &shard.blocks[blockIdx]
+	if b.br != nil {
+		shard.stateSizeBudget += b.br.sizeBytes()
+	}
+	shard.blocks[blockIdx] = sortBlock{}
+}
+
+// pruneEmptyBlocks compacts already-freed blocks out of shard.blocks, wherever
+// in the slice they are, so the slice (and the backing block memory) actually
+// shrinks over time instead of only ever growing - see freeBlock().
+//
+// Freed blocks aren't necessarily a leading run: writeBlockTopN()'s heap evicts
+// whichever row currently sorts worst, regardless of which block it came from,
+// so a block in the middle of shard.blocks can become fully unreferenced while
+// older blocks around it are still kept.
+func (shard *pipeSortProcessorShard) pruneEmptyBlocks() {
+	blocks := shard.blocks
+	blockRefCounts := shard.blockRefCounts
+
+	anyFreed := false
+	for i := range blocks {
+		if blocks[i].br == nil && blockRefCounts[i] == 0 {
+			anyFreed = true
+			break
+		}
+	}
+	if !anyFreed {
+		return
+	}
+
+	remap := shard.blockIdxRemap
+	if cap(remap) < len(blocks) {
+		remap = make([]int, len(blocks))
+	} else {
+		remap = remap[:len(blocks)]
+	}
+
+	n := 0
+	for i := range blocks {
+		if blocks[i].br == nil && blockRefCounts[i] == 0 {
+			remap[i] = -1
+			continue
+		}
+		remap[i] = n
+		blocks[n] = blocks[i]
+		blockRefCounts[n] = blockRefCounts[i]
+		n++
+	}
+	shard.blocks = blocks[:n]
+	shard.blockRefCounts = blockRefCounts[:n]
+	shard.blockIdxRemap = remap
+
+	for i := range shard.rowRefs {
+		shard.rowRefs[i].blockIdx = remap[shard.rowRefs[i].blockIdx]
+	}
+}
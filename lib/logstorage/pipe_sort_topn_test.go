@@ -0,0 +1,132 @@
+package logstorage
+
+import (
+	"testing"
+)
+
+// TestPipeSortWriteBlockTopN exercises pipeSortProcessorShard.writeBlockTopN() directly,
+// since ps.limit isn't wired up by the query planner yet - see the TODO on pipeSort.limit.
+func TestPipeSortWriteBlockTopN(t *testing.T) {
+	ps := &pipeSort{
+		byFields: []*bySortField{
+			{name: "x"},
+		},
+		limit: 3,
+	}
+
+	shard := &pipeSortProcessorShard{}
+	shard.ps = ps
+
+	// Feed the rows one block at a time, in an order that forces evictions
+	// in the middle of the stream rather than only at the end.
+	values := []string{"5", "1", "4", "2", "3"}
+	for _, v := range values {
+		block := sortBlock{
+			br: &blockResult{
+				timestamps: []int64{0},
+			},
+			byColumns: []sortBlockByColumn{
+				{
+					c: &blockResultColumn{
+						isConst:       true,
+						encodedValues: []string{v},
+					},
+				},
+			},
+		}
+		shard.blocks = append(shard.blocks, block)
+		shard.blockRefCounts = append(shard.blockRefCounts, 0)
+		shard.writeBlockTopN(len(shard.blocks) - 1)
+	}
+
+	if got := len(shard.rowRefs); got != 3 {
+		t.Fatalf("unexpected number of rows kept; got %d; want 3", got)
+	}
+
+	kept := make(map[string]bool, len(shard.rowRefs))
+	for _, rr := range shard.rowRefs {
+		b := &shard.blocks[rr.blockIdx]
+		kept[b.byColumns[0].c.encodedValues[0]] = true
+	}
+	for _, v := range []string{"1", "2", "3"} {
+		if !kept[v] {
+			t.Fatalf("expected value %q to be among the top-3 kept rows; kept=%v", v, kept)
+		}
+	}
+	for _, v := range []string{"4", "5"} {
+		if kept[v] {
+			t.Fatalf("value %q should have been evicted from the top-3 window; kept=%v", v, kept)
+		}
+	}
+
+	// Blocks evicted and freed early in the stream should shrink shard.blocks
+	// via pruneEmptyBlocks(), instead of leaving it growing forever.
+	if got, want := len(shard.blocks), len(values); got >= want {
+		t.Fatalf("expected freed leading blocks to be pruned; shard.blocks has %d entries, started with %d", got, want)
+	}
+}
+
+// TestPipeSortWriteBlockTopNPrunesMiddleBlocks is a regression test for
+// pruneEmptyBlocks() only reclaiming a leading run of freed blocks: since the
+// heap in writeBlockTopN() evicts whichever row currently sorts worst, a block
+// can end up fully unreferenced while older blocks around it are still kept,
+// leaving a freed block stranded in the middle of shard.blocks.
+func TestPipeSortWriteBlockTopNPrunesMiddleBlocks(t *testing.T) {
+	ps := &pipeSort{
+		byFields: []*bySortField{
+			{name: "x"},
+		},
+		limit: 2,
+	}
+
+	shard := &pipeSortProcessorShard{}
+	shard.ps = ps
+
+	write := func(v string) {
+		block := sortBlock{
+			br: &blockResult{
+				timestamps: []int64{0},
+			},
+			byColumns: []sortBlockByColumn{
+				{
+					c: &blockResultColumn{
+						isConst:       true,
+						encodedValues: []string{v},
+					},
+				},
+			},
+		}
+		shard.blocks = append(shard.blocks, block)
+		shard.blockRefCounts = append(shard.blockRefCounts, 0)
+		shard.writeBlockTopN(len(shard.blocks) - 1)
+	}
+
+	// block 0 ("1") and block 1 ("2") are both kept after these two writes.
+	write("1")
+	write("2")
+
+	// "0" beats both kept rows, evicting only "2" (block 1, the worse of the
+	// two) - block 0 stays kept, so the freed block is sandwiched between a
+	// kept block before it and a kept block (this new one) after it.
+	write("0")
+
+	kept := make(map[string]bool, len(shard.rowRefs))
+	for _, rr := range shard.rowRefs {
+		b := &shard.blocks[rr.blockIdx]
+		kept[b.byColumns[0].c.encodedValues[0]] = true
+	}
+	for _, v := range []string{"0", "1"} {
+		if !kept[v] {
+			t.Fatalf("expected value %q to be among the top-2 kept rows; kept=%v", v, kept)
+		}
+	}
+	if kept["2"] {
+		t.Fatalf(`value "2" should have been evicted; kept=%v`, kept)
+	}
+
+	// The freed, middle block (originally holding "2") must be compacted out
+	// even though it isn't part of a leading run of freed blocks.
+	if got, want := len(shard.blocks), 2; got != want {
+		t.Fatalf("expected the freed middle block to be pruned; shard.blocks has %d entries, want %d", got, want)
+	}
+}